@@ -0,0 +1,133 @@
+package nomad
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// clientConfig holds everything needed to build the HTTP client the plugin
+// uses to talk to Nomad: ACL token plus mTLS/HTTPS transport settings, all
+// sourced from the Corefile at setup time.
+type clientConfig struct {
+	Token              string
+	TokenFile          string
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	TLSServerName      string
+	InsecureSkipVerify bool
+	AllowInsecureToken bool
+	Timeout            time.Duration
+}
+
+// resolveToken returns the configured token, reading it from TokenFile when
+// set, and enforces that a token is never sent over plaintext HTTP unless
+// AllowInsecureToken was explicitly set.
+func (cfg *clientConfig) resolveToken(nomadAddr string) (string, error) {
+	token := cfg.Token
+	if cfg.TokenFile != "" {
+		b, err := os.ReadFile(cfg.TokenFile)
+		if err != nil {
+			return "", fmt.Errorf("reading token_file: %w", err)
+		}
+		token = strings.TrimSpace(string(b))
+	}
+
+	if err := checkPlaintextToken(token, nomadAddr, cfg.AllowInsecureToken); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// checkPlaintextToken refuses to let a non-empty ACL token ride along with a
+// plaintext http:// address unless the operator explicitly opted in with
+// allow_insecure_token. resolveToken applies this to the top-level address;
+// parseNomad applies it again to every region, since a region can override
+// both its address and its token independently of the top level.
+func checkPlaintextToken(token, nomadAddr string, allowInsecure bool) error {
+	if token != "" && strings.HasPrefix(nomadAddr, "http://") && !allowInsecure {
+		return fmt.Errorf("refusing to send a Nomad ACL token over plaintext %q; use https:// or set allow_insecure_token", nomadAddr)
+	}
+	return nil
+}
+
+// nomadBlockingWait is the "wait" duration watchers ask Nomad's blocking
+// queries to hold open (see fetchHealth in nomad.go); the blocking client's
+// Timeout (this plus blockingClientMargin, set in buildHTTPClient) must stay
+// comfortably longer than this; otherwise the HTTP client
+// itself would abort the round trip before Nomad's wait window could ever
+// return a real change.
+const nomadBlockingWait = 5 * time.Minute
+
+// blockingClientMargin is added on top of nomadBlockingWait when sizing the
+// blocking client's Timeout, to absorb network latency around Nomad's own
+// deadline.
+const blockingClientMargin = 30 * time.Second
+
+// buildHTTPClient builds the *http.Client the plugin reuses for every
+// ordinary request to Nomad, configuring mTLS when cert/key material is
+// supplied and sizing the transport's connection pool for the plugin's
+// expected concurrency (one connection per in-flight lookup or watcher). It
+// also returns a second client, sharing the same transport (and so the same
+// connection pool), sized for watchers' blocking queries: http.Client.Timeout
+// bounds the entire round trip regardless of context deadlines, so reusing
+// the short general-purpose timeout here would abort every blocking query
+// well before Nomad's wait window could return.
+func buildHTTPClient(cfg *clientConfig) (client, blockingClient *http.Client, err error) {
+	tlsConfig := &tls.Config{
+		ServerName:         cfg.TLSServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading ca_file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("no certificates found in ca_file %q", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		if cfg.CertFile == "" || cfg.KeyFile == "" {
+			return nil, nil, fmt.Errorf("cert_file and key_file must both be set")
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("loading cert_file/key_file: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := &http.Transport{
+		TLSClientConfig:     tlsConfig,
+		MaxIdleConns:        64,
+		MaxIdleConnsPerHost: 64,
+		IdleConnTimeout:     90 * time.Second,
+	}
+
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+
+	client = &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+	}
+	blockingClient = &http.Client{
+		Transport: transport,
+		Timeout:   nomadBlockingWait + blockingClientMargin,
+	}
+
+	return client, blockingClient, nil
+}
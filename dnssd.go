@@ -0,0 +1,200 @@
+package nomad
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// dnssdEnumQname is the RFC 6763 §9 service-type enumeration name: clients
+// query it with PTR to discover what service names exist under a domain.
+const dnssdEnumQname = "_services._dns-sd._udp"
+
+// dnssdResult carries ServeDNS's (rcode, err) return values out of
+// serveDNSSD so it can be tried as an early, optional branch.
+type dnssdResult struct {
+	rcode int
+	err   error
+}
+
+// serveDNSSD answers the three DNS-SD query shapes this plugin supports:
+// service-type enumeration, per-service PTR (instance listing), and
+// per-instance TXT (tags). ok is false when rest/qtype don't match any of
+// them, meaning ServeDNS should fall through to its normal service lookup.
+func (n *Nomad) serveDNSSD(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, qname, rest string, qtype uint16) (dnssdResult, bool) {
+	if rest == dnssdEnumQname && qtype == dns.TypePTR {
+		return n.serveServiceEnum(w, r, qname), true
+	}
+
+	labels := strings.Split(rest, ".")
+
+	if qtype == dns.TypePTR && len(labels) == 1 {
+		return n.serveInstancePTR(w, r, qname, rest), true
+	}
+
+	if qtype == dns.TypeTXT && len(labels) == 2 {
+		return n.serveInstanceTXT(w, r, qname, labels[1], labels[0]), true
+	}
+
+	return dnssdResult{}, false
+}
+
+// serveServiceEnum answers "_services._dns-sd._udp.<domain>" PTR queries
+// with one PTR per distinct Nomad service name.
+func (n *Nomad) serveServiceEnum(w dns.ResponseWriter, r *dns.Msg, qname string) dnssdResult {
+	names, err := n.fetchServiceNames(n.primaryBackend())
+	if err != nil {
+		return dnssdResult{dns.RcodeServerFailure, err}
+	}
+	if len(names) == 0 {
+		return dnssdResult{dns.RcodeNameError, nil}
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	for _, name := range names {
+		m.Answer = append(m.Answer, &dns.PTR{
+			Hdr: dns.RR_Header{Name: qname, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 30},
+			Ptr: name + "." + n.Domain,
+		})
+	}
+
+	w.WriteMsg(m)
+	return dnssdResult{dns.RcodeSuccess, nil}
+}
+
+// serveInstancePTR answers PTR queries against "<service>.<domain>" with
+// one PTR per healthy instance, pointing at its "<instance>.<service>.
+// <domain>" name.
+func (n *Nomad) serveInstancePTR(w dns.ResponseWriter, r *dns.Msg, qname, service string) dnssdResult {
+	matched, _, _, err := n.resolve(r, query{service: service})
+	if err != nil {
+		return dnssdResult{dns.RcodeServerFailure, err}
+	}
+	instances := matched.all()
+	if len(instances) == 0 {
+		return dnssdResult{dns.RcodeNameError, nil}
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	for _, inst := range instances {
+		m.Answer = append(m.Answer, &dns.PTR{
+			Hdr: dns.RR_Header{Name: qname, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 30},
+			Ptr: instanceLabel(inst) + "." + qname,
+		})
+	}
+
+	w.WriteMsg(m)
+	return dnssdResult{dns.RcodeSuccess, nil}
+}
+
+// serveInstanceTXT answers TXT queries against "<instance>.<service>.
+// <domain>" with the matching instance's tags, one key=value TXT string per
+// tag.
+func (n *Nomad) serveInstanceTXT(w dns.ResponseWriter, r *dns.Msg, qname, service, instance string) dnssdResult {
+	matched, _, _, err := n.resolve(r, query{service: service})
+	if err != nil {
+		return dnssdResult{dns.RcodeServerFailure, err}
+	}
+
+	for _, inst := range matched.all() {
+		if instanceLabel(inst) != instance {
+			continue
+		}
+
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Authoritative = true
+		m.Answer = append(m.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: qname, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 30},
+			Txt: encodeTagsTXT(inst.Tags),
+		})
+
+		w.WriteMsg(m)
+		return dnssdResult{dns.RcodeSuccess, nil}
+	}
+
+	return dnssdResult{dns.RcodeNameError, nil}
+}
+
+// encodeTagsTXT renders Nomad service tags as key=value TXT strings. A tag
+// already in "key=value" form (Nomad's convention for tags like
+// "version=3") passes through unchanged; a bare tag (e.g. "canary") is
+// encoded as "tag=canary" so every TXT string has the same shape.
+func encodeTagsTXT(tags []string) []string {
+	encoded := make([]string, len(tags))
+	for i, t := range tags {
+		if strings.Contains(t, "=") {
+			encoded[i] = t
+		} else {
+			encoded[i] = "tag=" + t
+		}
+	}
+	return encoded
+}
+
+// instanceLabel builds a stable, DNS-safe label identifying one instance
+// within a service, used as the left-most label of its PTR/TXT name.
+func instanceLabel(inst serviceInstance) string {
+	return sanitizeLabel(fmt.Sprintf("%s-%d", inst.Node, inst.Port))
+}
+
+// primaryBackend returns the backend to use for catalog-wide operations
+// (service-type enumeration) that aren't scoped to a single lookup: the
+// first configured region, or the single-region default.
+func (n *Nomad) primaryBackend() *backend {
+	if len(n.Regions) > 0 {
+		return n.Regions[0]
+	}
+	return n.defaultBackend()
+}
+
+// fetchServiceNames calls Nomad's /v1/services endpoint and returns the
+// distinct service names across the namespace groups in its response. No
+// namespace parameter is sent, so Nomad answers for its default namespace.
+func (n *Nomad) fetchServiceNames(b *backend) ([]string, error) {
+	url := fmt.Sprintf("%s/v1/services", b.NomadAddr)
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if b.Token != "" {
+		req.Header.Set("X-Nomad-Token", b.Token)
+	}
+
+	resp, err := b.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result []struct {
+		Services []struct {
+			ServiceName string `json:"ServiceName"`
+		} `json:"Services"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var names []string
+	for _, ns := range result {
+		for _, svc := range ns.Services {
+			if svc.ServiceName == "" || seen[svc.ServiceName] {
+				continue
+			}
+			seen[svc.ServiceName] = true
+			names = append(names, svc.ServiceName)
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,45 @@
+package nomad
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEncodeTagsTXT(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []string
+		want []string
+	}{
+		{"bare tag gets a tag= key", []string{"canary"}, []string{"tag=canary"}},
+		{"key=value tag passes through", []string{"version=3"}, []string{"version=3"}},
+		{"mixed tags", []string{"canary", "version=3"}, []string{"tag=canary", "version=3"}},
+		{"empty input", nil, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := encodeTagsTXT(tt.in)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("encodeTagsTXT(%v) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInstanceLabel(t *testing.T) {
+	tests := []struct {
+		name string
+		inst serviceInstance
+		want string
+	}{
+		{"simple node name", serviceInstance{Node: "web-01", Port: 8080}, "web-01-8080"},
+		{"node name needs sanitizing", serviceInstance{Node: "node.us-east-1", Port: 53}, "node-us-east-1-53"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := instanceLabel(tt.inst); got != tt.want {
+				t.Errorf("instanceLabel(%+v) = %q, want %q", tt.inst, got, tt.want)
+			}
+		})
+	}
+}
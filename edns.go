@@ -0,0 +1,44 @@
+package nomad
+
+import "github.com/miekg/dns"
+
+// clientSubnet returns the EDNS0 Client Subnet option on r, if the client
+// sent one, for use in region-aware routing (RFC 7871).
+func clientSubnet(r *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if subnet, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return subnet
+		}
+	}
+	return nil
+}
+
+// echoClientSubnet attaches an EDNS0 Client Subnet option to m mirroring
+// the client's request, with SourceScope set to the prefix length of the
+// region CIDR that the query was matched against, so downstream resolvers
+// know how narrowly the answer was scoped.
+func echoClientSubnet(m *dns.Msg, req *dns.EDNS0_SUBNET, scope int) {
+	if req == nil {
+		return
+	}
+
+	o := m.IsEdns0()
+	if o == nil {
+		o = new(dns.OPT)
+		o.Hdr.Name = "."
+		o.Hdr.Rrtype = dns.TypeOPT
+		m.Extra = append(m.Extra, o)
+	}
+
+	o.Option = append(o.Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        req.Family,
+		SourceNetmask: req.SourceNetmask,
+		SourceScope:   uint8(scope),
+		Address:       req.Address,
+	})
+}
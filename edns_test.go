@@ -0,0 +1,83 @@
+package nomad
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func msgWithSubnet(subnet *dns.EDNS0_SUBNET) *dns.Msg {
+	m := new(dns.Msg)
+	if subnet == nil {
+		return m
+	}
+	o := new(dns.OPT)
+	o.Hdr.Name = "."
+	o.Hdr.Rrtype = dns.TypeOPT
+	o.Option = append(o.Option, subnet)
+	m.Extra = append(m.Extra, o)
+	return m
+}
+
+func TestClientSubnet(t *testing.T) {
+	t.Run("no EDNS0 returns nil", func(t *testing.T) {
+		if got := clientSubnet(msgWithSubnet(nil)); got != nil {
+			t.Errorf("clientSubnet() = %+v, want nil", got)
+		}
+	})
+
+	t.Run("extracts the EDNS0_SUBNET option", func(t *testing.T) {
+		want := &dns.EDNS0_SUBNET{Address: net.ParseIP("10.1.2.3"), SourceNetmask: 24}
+		got := clientSubnet(msgWithSubnet(want))
+		if got != want {
+			t.Errorf("clientSubnet() = %+v, want %+v", got, want)
+		}
+	})
+}
+
+func TestEchoClientSubnet(t *testing.T) {
+	t.Run("nil request is a no-op", func(t *testing.T) {
+		m := new(dns.Msg)
+		echoClientSubnet(m, nil, 0)
+		if len(m.Extra) != 0 {
+			t.Errorf("echoClientSubnet() added records for a nil request")
+		}
+	})
+
+	t.Run("attaches an OPT record with the matched scope", func(t *testing.T) {
+		req := &dns.EDNS0_SUBNET{Family: 1, SourceNetmask: 24, Address: net.ParseIP("10.1.2.3")}
+		m := new(dns.Msg)
+		echoClientSubnet(m, req, 16)
+
+		opt := m.IsEdns0()
+		if opt == nil {
+			t.Fatalf("echoClientSubnet() did not attach an OPT record")
+		}
+		if len(opt.Option) != 1 {
+			t.Fatalf("echoClientSubnet() OPT has %d options, want 1", len(opt.Option))
+		}
+		got, ok := opt.Option[0].(*dns.EDNS0_SUBNET)
+		if !ok {
+			t.Fatalf("echoClientSubnet() option is %T, want *dns.EDNS0_SUBNET", opt.Option[0])
+		}
+		if got.SourceScope != 16 || got.Family != req.Family || got.SourceNetmask != req.SourceNetmask {
+			t.Errorf("echoClientSubnet() = %+v, want scope 16 mirroring %+v", got, req)
+		}
+	})
+
+	t.Run("reuses an existing OPT record", func(t *testing.T) {
+		req := &dns.EDNS0_SUBNET{Address: net.ParseIP("10.1.2.3")}
+		m := msgWithSubnet(nil)
+		o := new(dns.OPT)
+		o.Hdr.Name = "."
+		o.Hdr.Rrtype = dns.TypeOPT
+		m.Extra = append(m.Extra, o)
+
+		echoClientSubnet(m, req, 8)
+
+		if len(m.Extra) != 1 {
+			t.Errorf("echoClientSubnet() created a second OPT record instead of reusing the existing one")
+		}
+	})
+}
@@ -0,0 +1,112 @@
+package nomad
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// metricsUnmatchedLabel and metricsDNSSDLabel are the fixed "service" label
+// buckets used in place of raw query text. qnames come straight from DNS
+// clients, so labeling requestCount with them directly would let any client
+// mint unbounded distinct label values (a Prometheus cardinality-explosion
+// DoS); recordRequest only uses the real service name once a query actually
+// resolved against a known, healthy Nomad service.
+const (
+	metricsUnmatchedLabel = "_unmatched"
+	metricsDNSSDLabel     = "_dnssd"
+)
+
+var (
+	requestCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "nomad",
+		Name:      "request_count_total",
+		Help:      "Counter of DNS requests handled by the nomad plugin, labeled by service for matched queries and bucketed (\"_unmatched\", \"_dnssd\") otherwise to bound cardinality.",
+	}, []string{"service", "type", "rcode"})
+
+	cacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "nomad",
+		Name:      "cache_hits_total",
+		Help:      "Counter of lookups served from the cache without calling Nomad.",
+	})
+
+	cacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "nomad",
+		Name:      "cache_misses_total",
+		Help:      "Counter of lookups that had to call Nomad to refresh the cache.",
+	})
+
+	upstreamRequestDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "nomad",
+		Name:      "upstream_request_duration_seconds",
+		Help:      "Histogram of the time spent calling the Nomad HTTP API.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	upstreamErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "nomad",
+		Name:      "upstream_errors_total",
+		Help:      "Counter of failed Nomad HTTP API calls, by reason.",
+	}, []string{"reason"})
+
+	cacheEntries = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "nomad",
+		Name:      "cache_entries",
+		Help:      "Number of service cache entries currently held.",
+	})
+)
+
+// recordRequest records one handled query's outcome. service must already be
+// bounded to a known Nomad service name or one of the fixed metrics*Label
+// buckets above.
+func recordRequest(service string, qtype uint16, rcode int) {
+	requestCount.WithLabelValues(service, dns.TypeToString[qtype], rcodeToString(rcode)).Inc()
+}
+
+// recordCacheHit/recordCacheMiss record whether lookupService served from
+// the cache or had to call Nomad. Unlabeled, since the service name behind a
+// given lookup is attacker-influenced qname text.
+func recordCacheHit()  { cacheHits.Inc() }
+func recordCacheMiss() { cacheMisses.Inc() }
+
+// observeUpstream records the duration of a Nomad HTTP API call, and
+// classifies any error into a small set of reasons for upstreamErrors.
+func observeUpstream(start time.Time, statusCode int, err error) {
+	upstreamRequestDuration.Observe(time.Since(start).Seconds())
+
+	switch {
+	case err != nil:
+		reason := "timeout"
+		if ne, ok := err.(interface{ Timeout() bool }); !ok || !ne.Timeout() {
+			reason = "error"
+		}
+		upstreamErrors.WithLabelValues(reason).Inc()
+	case statusCode >= 500:
+		upstreamErrors.WithLabelValues("5xx").Inc()
+	}
+}
+
+// setCacheEntries updates the cache_entries gauge. Callers must hold
+// CacheMutex (for a consistent read) before calling.
+func (n *Nomad) setCacheEntries() {
+	cacheEntries.Set(float64(len(n.Cache)))
+}
+
+// rcodeToString renders an rcode the way other CoreDNS plugins label their
+// metrics: the mnemonic from miekg/dns, falling back to the bare number.
+func rcodeToString(rcode int) string {
+	if name, ok := dns.RcodeToString[rcode]; ok {
+		return name
+	}
+	return strconv.Itoa(rcode)
+}
@@ -1,138 +1,589 @@
 package nomad
 
 import (
-    "context"
-    "encoding/json"
-    "fmt"
-    "net"
-    "net/http"
-    "strings"
-    "sync"
-    "time"
-
-    "github.com/coredns/coredns/plugin"
-    "github.com/coredns/coredns/plugin/pkg/dnsutil"
-    "github.com/miekg/dns"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/dnsutil"
+	"github.com/miekg/dns"
 )
 
+// serviceInstance describes a single healthy allocation backing a Nomad service.
+type serviceInstance struct {
+	IP         net.IP
+	Port       int
+	Node       string
+	Tags       []string
+	Datacenter string
+}
+
+// addressFamilySet splits a service's healthy instances by IP address
+// family so dual-stack lookups don't need to re-classify addresses on
+// every query.
+type addressFamilySet struct {
+	V4 []serviceInstance
+	V6 []serviceInstance
+}
+
+// all returns the V4 and V6 instances concatenated, V4 first.
+func (s addressFamilySet) all() []serviceInstance {
+	if len(s.V4) == 0 {
+		return s.V6
+	}
+	if len(s.V6) == 0 {
+		return s.V4
+	}
+	combined := make([]serviceInstance, 0, len(s.V4)+len(s.V6))
+	combined = append(combined, s.V4...)
+	combined = append(combined, s.V6...)
+	return combined
+}
+
+// filter returns a new addressFamilySet containing only instances matching
+// q's tag/protocol filters.
+func (s addressFamilySet) filter(q query) addressFamilySet {
+	var out addressFamilySet
+	for _, inst := range s.V4 {
+		if q.matches(inst) {
+			out.V4 = append(out.V4, inst)
+		}
+	}
+	for _, inst := range s.V6 {
+		if q.matches(inst) {
+			out.V6 = append(out.V6, inst)
+		}
+	}
+	return out
+}
+
+// ordered returns the V4 and V6 instances concatenated in the order implied
+// by a "prefer" Corefile setting of "v4", "v6", or "dual" (default v4-first).
+func (s addressFamilySet) ordered(prefer string) []serviceInstance {
+	if prefer == "v6" {
+		combined := make([]serviceInstance, 0, len(s.V4)+len(s.V6))
+		combined = append(combined, s.V6...)
+		combined = append(combined, s.V4...)
+		return combined
+	}
+	return s.all()
+}
+
 // Plugin struct
 type Nomad struct {
-    Next       plugin.Handler
-    Domain     string
-    NomadAddr  string
-    Cache      map[string][]net.IP
-    CacheMutex sync.RWMutex
-    CacheTTL   time.Duration
-    CacheTime  map[string]time.Time
+	Next       plugin.Handler
+	Domain     string
+	NomadAddr  string
+	Cache      map[string]addressFamilySet
+	CacheMutex sync.RWMutex
+	CacheTTL   time.Duration
+	CacheTime  map[string]time.Time
+
+	// Prefer orders dual-stack answers ("v4" or "v6"); IPv4Only/IPv6Only
+	// drop the other family entirely regardless of query type.
+	Prefer   string
+	IPv4Only bool
+	IPv6Only bool
+
+	// Regions holds one backend per configured "region" block, each with
+	// its own Nomad cluster, credentials, and CIDR/datacenter locality
+	// hints for EDNS0 client-subnet aware routing. Empty when the plugin
+	// is configured single-region, in which case defaultBackend() is used.
+	Regions []*backend
+
+	// Watch enables blocking-query watchers instead of TTL polling: the
+	// first lookup of a service primes the cache and spawns a watcher
+	// goroutine, and every subsequent lookup is a non-blocking cache read.
+	Watch       bool
+	MaxWatchers int
+
+	// Token is sent as X-Nomad-Token on every request; HTTPClient and
+	// BlockingHTTPClient are built at setup time from the Corefile's
+	// TLS/token configuration and share a transport, but BlockingHTTPClient
+	// carries a much longer Timeout so watchers' blocking queries aren't
+	// aborted before Nomad's own wait window can return.
+	Token              string
+	HTTPClient         *http.Client
+	BlockingHTTPClient *http.Client
+
+	watchers   map[string]*watcher
+	watchersMu sync.Mutex
+	shutdown   chan struct{}
+	wg         sync.WaitGroup
+}
+
+// New returns a Nomad plugin with its maps and defaults initialized.
+func New() *Nomad {
+	return &Nomad{
+		Cache:              make(map[string]addressFamilySet),
+		CacheTime:          make(map[string]time.Time),
+		CacheTTL:           30 * time.Second,
+		MaxWatchers:        256,
+		Prefer:             "v4",
+		HTTPClient:         http.DefaultClient,
+		BlockingHTTPClient: http.DefaultClient,
+		watchers:           make(map[string]*watcher),
+		shutdown:           make(chan struct{}),
+	}
 }
 
 // Ensure Nomad implements plugin.Handler
 var _ plugin.Handler = &Nomad{}
 
+// query holds the parsed components of a qname once the domain suffix has
+// been stripped: the Nomad service name plus any Consul-style tag or
+// protocol filters carried in the left-most labels.
+type query struct {
+	service string
+	tag     string
+	proto   string
+}
+
+// parseQuery splits the remaining labels of a qname (after the plugin's
+// Domain has been trimmed) into a service name and optional tag/protocol
+// filters, mirroring the label conventions used by CoreDNS's Consul-style
+// plugins: "tag.service" filters by tag, "_service._proto" filters by
+// protocol.
+func parseQuery(name string) query {
+	labels := strings.Split(name, ".")
+	if len(labels) == 2 && strings.HasPrefix(labels[0], "_") && strings.HasPrefix(labels[1], "_") {
+		return query{
+			service: strings.TrimPrefix(labels[0], "_"),
+			proto:   strings.TrimPrefix(labels[1], "_"),
+		}
+	}
+	if len(labels) == 2 {
+		return query{
+			tag:     labels[0],
+			service: labels[1],
+		}
+	}
+	return query{service: name}
+}
+
+// nonTCPProtoTag is the tag Nomad operators use to mark a service instance
+// as not answering on TCP, since Nomad service registrations have no
+// first-class protocol field.
+const nonTCPProtoTag = "udp"
+
+// hasTag reports whether tags contains t.
+func hasTag(tags []string, t string) bool {
+	for _, tag := range tags {
+		if tag == t {
+			return true
+		}
+	}
+	return false
+}
+
+// matches reports whether the instance satisfies the query's tag and
+// protocol filters, if any were specified.
+func (q query) matches(inst serviceInstance) bool {
+	if q.tag != "" && !hasTag(inst.Tags, q.tag) {
+		return false
+	}
+	switch q.proto {
+	case "":
+		// no protocol filter
+	case "tcp":
+		// "_service._tcp" asks for the default TCP view: exclude instances
+		// explicitly tagged as answering on a non-TCP protocol instead.
+		if hasTag(inst.Tags, nonTCPProtoTag) {
+			return false
+		}
+	default:
+		if !hasTag(inst.Tags, q.proto) {
+			return false
+		}
+	}
+	return true
+}
+
 // ServeDNS handles DNS queries
-func (n *Nomad) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
-    state := plugin.State{W: w, Req: r}
-    qname := state.Name()
-    if !dnsutil.IsSubDomain(n.Domain, qname) {
-        return plugin.NextOrFailure(n.Name(), n.Next, ctx, w, r)
-    }
-
-    service := strings.TrimSuffix(qname, "."+n.Domain)
-    service = strings.TrimSuffix(service, ".") // remove trailing dot if any
-
-    ips, err := n.lookupService(service)
-    if err != nil {
-        return dns.RcodeServerFailure, err
-    }
-    if len(ips) == 0 {
-        return dns.RcodeNameError, nil // NXDOMAIN
-    }
-
-    m := new(dns.Msg)
-    m.SetReply(r)
-    m.Authoritative = true
-
-    for _, ip := range ips {
-        rr := &dns.A{
-            Hdr: dns.RR_Header{
-                Name:   qname,
-                Rrtype: dns.TypeA,
-                Class:  dns.ClassINET,
-                Ttl:    30,
-            },
-            A: ip,
-        }
-        m.Answer = append(m.Answer, rr)
-    }
-
-    w.WriteMsg(m)
-    return dns.RcodeSuccess, nil
-}
-
-// lookupService queries Nomad API for service IPs with caching
-func (n *Nomad) lookupService(service string) ([]net.IP, error) {
-    n.CacheMutex.RLock()
-    ips, ok := n.Cache[service]
-    t, timeOk := n.CacheTime[service]
-    n.CacheMutex.RUnlock()
-
-    if ok && timeOk && time.Since(t) < n.CacheTTL {
-        return ips, nil
-    }
-
-    // Query Nomad API for service allocations
-    url := fmt.Sprintf("%s/v1/health/service/%s", n.NomadAddr, service)
-    resp, err := http.Get(url)
-    if err != nil {
-        return nil, err
-    }
-    defer resp.Body.Close()
-
-    var result []struct {
-        Service struct {
-            Address string `json:"Address"`
-        } `json:"Service"`
-        Checks []struct {
-            Status string `json:"Status"`
-        } `json:"Checks"`
-        Node struct {
-            Address string `json:"Address"`
-        } `json:"Node"`
-    }
-    if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-        return nil, err
-    }
-
-    var serviceIPs []net.IP
-    for _, entry := range result {
-        // Only include services with passing health
-        healthy := true
-        for _, check := range entry.Checks {
-            if check.Status != "passing" {
-                healthy = false
-                break
-            }
-        }
-        if !healthy {
-            continue
-        }
-        ip := net.ParseIP(entry.Service.Address)
-        if ip == nil {
-            ip = net.ParseIP(entry.Node.Address)
-        }
-        if ip != nil {
-            serviceIPs = append(serviceIPs, ip)
-        }
-    }
-
-    // Update cache
-    n.CacheMutex.Lock()
-    n.Cache[service] = serviceIPs
-    n.CacheTime[service] = time.Now()
-    n.CacheMutex.Unlock()
-
-    return serviceIPs, nil
+func (n *Nomad) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (rcode int, err error) {
+	state := plugin.State{W: w, Req: r}
+	qname := state.Name()
+	qtype := state.QType()
+	if !dnsutil.IsSubDomain(n.Domain, qname) {
+		return plugin.NextOrFailure(n.Name(), n.Next, ctx, w, r)
+	}
+
+	rest := strings.TrimSuffix(qname, "."+n.Domain)
+	rest = strings.TrimSuffix(rest, ".") // remove trailing dot if any
+
+	// svcLabel is the Prometheus "service" label for this request; see the
+	// metrics*Label doc comment in metrics.go for why it starts bucketed and
+	// is only replaced with a real service name once the query resolves.
+	svcLabel := metricsUnmatchedLabel
+	defer func() { recordRequest(svcLabel, qtype, rcode) }()
+
+	if dnssd, ok := n.serveDNSSD(ctx, w, r, qname, rest, qtype); ok {
+		svcLabel = metricsDNSSDLabel
+		return dnssd.rcode, dnssd.err
+	}
+
+	q := parseQuery(rest)
+
+	matched, chosen, scope, err := n.resolve(r, q)
+	if err != nil {
+		return dns.RcodeServerFailure, err
+	}
+	if chosen == nil {
+		return dns.RcodeNameError, nil // NXDOMAIN: no such service, or no instance matches the filters
+	}
+	svcLabel = q.service
+
+	matched.V4 = sortByDatacenter(matched.V4, chosen.Datacenter)
+	matched.V6 = sortByDatacenter(matched.V6, chosen.Datacenter)
+
+	// A narrower (region-scoped) answer is only safe to cache as long as
+	// that scoping remains valid downstream, so shrink the TTL.
+	ttl := uint32(30)
+	if scope > 0 {
+		ttl = 5
+	}
+
+	ecs := clientSubnet(r)
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+
+	// A query type with no matching address family still gets NOERROR
+	// with an empty answer, per RFC 8020, rather than NXDOMAIN.
+	switch qtype {
+	case dns.TypeA:
+		m.Answer = append(m.Answer, aAnswers(qname, matched.V4, ttl)...)
+	case dns.TypeAAAA:
+		m.Answer = append(m.Answer, aaaaAnswers(qname, matched.V6, ttl)...)
+	case dns.TypeSRV:
+		ordered := matched.ordered(n.Prefer)
+		m.Answer = append(m.Answer, srvAnswers(qname, n.Domain, ordered, ttl)...)
+		m.Extra = append(m.Extra, additionalAddresses(n.Domain, ordered, ttl)...)
+	case dns.TypeANY:
+		ordered := matched.ordered(n.Prefer)
+		m.Answer = append(m.Answer, aAnswers(qname, matched.V4, ttl)...)
+		m.Answer = append(m.Answer, aaaaAnswers(qname, matched.V6, ttl)...)
+		m.Answer = append(m.Answer, srvAnswers(qname, n.Domain, ordered, ttl)...)
+		m.Extra = append(m.Extra, additionalAddresses(n.Domain, ordered, ttl)...)
+	}
+
+	echoClientSubnet(m, ecs, scope)
+
+	w.WriteMsg(m)
+	return dns.RcodeSuccess, nil
 }
 
-func (n *Nomad) Name() string { return "nomad" }
+// resolve picks the best-matching backend for q.service (steered by any
+// EDNS0 Client Subnet option on r) and returns its filtered, family-split
+// instances along with the CIDR match scope used for that backend. chosen
+// is nil when no backend has any matching instance; err is then set to the
+// last backend's query error if any candidate backend could not be queried.
+func (n *Nomad) resolve(r *dns.Msg, q query) (addressFamilySet, *backend, int, error) {
+	var clientIP net.IP
+	if ecs := clientSubnet(r); ecs != nil {
+		clientIP = ecs.Address
+	}
+	backends, scope := n.orderBackends(clientIP)
+
+	var lastErr error
+	for _, b := range backends {
+		set, err := n.lookupService(b, q.service)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		filtered := set.filter(q)
+		if n.IPv4Only {
+			filtered.V6 = nil
+		}
+		if n.IPv6Only {
+			filtered.V4 = nil
+		}
+		if len(filtered.V4) > 0 || len(filtered.V6) > 0 {
+			return filtered, b, scope, nil
+		}
+	}
+	return addressFamilySet{}, nil, scope, lastErr
+}
 
+// aAnswers builds the A records for the given qname and v4 instances.
+func aAnswers(qname string, instances []serviceInstance, ttl uint32) []dns.RR {
+	var answers []dns.RR
+	for _, inst := range instances {
+		answers = append(answers, &dns.A{
+			Hdr: dns.RR_Header{
+				Name:   qname,
+				Rrtype: dns.TypeA,
+				Class:  dns.ClassINET,
+				Ttl:    ttl,
+			},
+			A: inst.IP,
+		})
+	}
+	return answers
+}
+
+// aaaaAnswers builds the AAAA records for the given qname and v6 instances.
+func aaaaAnswers(qname string, instances []serviceInstance, ttl uint32) []dns.RR {
+	var answers []dns.RR
+	for _, inst := range instances {
+		answers = append(answers, &dns.AAAA{
+			Hdr: dns.RR_Header{
+				Name:   qname,
+				Rrtype: dns.TypeAAAA,
+				Class:  dns.ClassINET,
+				Ttl:    ttl,
+			},
+			AAAA: inst.IP,
+		})
+	}
+	return answers
+}
+
+// srvAnswers builds one SRV record per instance, targeting a synthetic
+// "<node>.node.<domain>" host name.
+func srvAnswers(qname, domain string, instances []serviceInstance, ttl uint32) []dns.RR {
+	var answers []dns.RR
+	for _, inst := range instances {
+		answers = append(answers, &dns.SRV{
+			Hdr: dns.RR_Header{
+				Name:   qname,
+				Rrtype: dns.TypeSRV,
+				Class:  dns.ClassINET,
+				Ttl:    ttl,
+			},
+			Priority: 10,
+			Weight:   10,
+			Port:     uint16(inst.Port),
+			Target:   nodeTarget(inst.Node, domain),
+		})
+	}
+	return answers
+}
+
+// additionalAddresses builds the glue A/AAAA records for the node targets
+// referenced by srvAnswers, for the Additional section of SRV responses.
+func additionalAddresses(domain string, instances []serviceInstance, ttl uint32) []dns.RR {
+	var extra []dns.RR
+	seen := make(map[string]bool)
+	for _, inst := range instances {
+		target := nodeTarget(inst.Node, domain)
+		if seen[target] {
+			continue
+		}
+		seen[target] = true
+
+		if ip4 := inst.IP.To4(); ip4 != nil {
+			extra = append(extra, &dns.A{
+				Hdr: dns.RR_Header{Name: target, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+				A:   ip4,
+			})
+		} else {
+			extra = append(extra, &dns.AAAA{
+				Hdr:  dns.RR_Header{Name: target, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: ttl},
+				AAAA: inst.IP,
+			})
+		}
+	}
+	return extra
+}
+
+// nodeTarget builds the "<node>.node.<domain>" host name used as an SRV
+// target, sanitizing the Nomad node name into a single valid DNS label.
+func nodeTarget(node, domain string) string {
+	label := dns.Fqdn(sanitizeLabel(node))
+	return strings.TrimSuffix(label, ".") + ".node." + domain
+}
+
+// sanitizeLabel replaces characters that are invalid in a DNS label so
+// Nomad node names can be used as SRV targets.
+func sanitizeLabel(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-':
+			return r
+		default:
+			return '-'
+		}
+	}, s)
+}
+
+// cacheKey namespaces a cache/watcher entry by the backend it was fetched
+// from, so the same service name in two regions doesn't collide.
+func cacheKey(b *backend, service string) string {
+	return b.Name + "/" + service
+}
+
+// lookupService returns the healthy instances for service from the given
+// backend, either from the watcher-maintained cache (Watch mode) or via
+// direct TTL-based polling of the Nomad API.
+func (n *Nomad) lookupService(b *backend, service string) (addressFamilySet, error) {
+	if n.Watch {
+		return n.lookupServiceWatched(b, service)
+	}
+	return n.lookupServicePolled(b, service)
+}
+
+// lookupServicePolled is the original on-demand behavior: consult the cache
+// and, once CacheTTL has elapsed, issue a plain (non-blocking) GET.
+func (n *Nomad) lookupServicePolled(b *backend, service string) (addressFamilySet, error) {
+	key := cacheKey(b, service)
+
+	n.CacheMutex.RLock()
+	set, ok := n.Cache[key]
+	t, timeOk := n.CacheTime[key]
+	n.CacheMutex.RUnlock()
+
+	if ok && timeOk && time.Since(t) < n.CacheTTL {
+		recordCacheHit()
+		return set, nil
+	}
+	recordCacheMiss()
+
+	fresh, _, err := n.fetchHealth(b, service, 0, false)
+	if err != nil {
+		return addressFamilySet{}, err
+	}
+
+	n.CacheMutex.Lock()
+	n.Cache[key] = fresh
+	n.CacheTime[key] = time.Now()
+	n.setCacheEntries()
+	n.CacheMutex.Unlock()
+
+	return fresh, nil
+}
+
+// lookupServiceWatched serves from the cache, only falling back to a
+// synchronous fetch on the first lookup of a service, and otherwise leaves
+// freshness to the service's watcher goroutine.
+func (n *Nomad) lookupServiceWatched(b *backend, service string) (addressFamilySet, error) {
+	key := cacheKey(b, service)
+
+	n.CacheMutex.RLock()
+	set, ok := n.Cache[key]
+	n.CacheMutex.RUnlock()
+
+	if ok {
+		n.touchWatcher(key)
+		recordCacheHit()
+		return set, nil
+	}
+	recordCacheMiss()
+
+	fresh, index, err := n.fetchHealth(b, service, 0, false)
+	if err != nil {
+		return addressFamilySet{}, err
+	}
+
+	n.CacheMutex.Lock()
+	n.Cache[key] = fresh
+	n.CacheTime[key] = time.Now()
+	n.setCacheEntries()
+	n.CacheMutex.Unlock()
+
+	n.startWatcher(b, service, index)
+
+	return fresh, nil
+}
+
+// fetchHealth calls Nomad's /v1/health/service/<service> endpoint on b's
+// cluster, decoding only the healthy entries into an addressFamilySet split
+// by IP version. When blocking is true, it issues a long-poll using
+// index/wait (bounded by nomadBlockingWait, see client.go). Blocking or not,
+// it returns the index from the X-Nomad-Index response header so the caller
+// can watch for the next change.
+func (n *Nomad) fetchHealth(b *backend, service string, index uint64, blocking bool) (addressFamilySet, uint64, error) {
+	url := fmt.Sprintf("%s/v1/health/service/%s", b.NomadAddr, service)
+	if blocking {
+		url = fmt.Sprintf("%s?index=%d&wait=%s", url, index, nomadBlockingWait)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return addressFamilySet{}, 0, err
+	}
+	if b.Token != "" {
+		req.Header.Set("X-Nomad-Token", b.Token)
+	}
+
+	httpClient := b.HTTPClient
+	if blocking {
+		httpClient = b.BlockingHTTPClient
+	}
+
+	start := time.Now()
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		observeUpstream(start, 0, err)
+		return addressFamilySet{}, 0, err
+	}
+	defer resp.Body.Close()
+	observeUpstream(start, resp.StatusCode, nil)
+
+	var result []struct {
+		Service struct {
+			Address string   `json:"Address"`
+			Port    int      `json:"Port"`
+			Tags    []string `json:"Tags"`
+		} `json:"Service"`
+		Checks []struct {
+			Status string `json:"Status"`
+		} `json:"Checks"`
+		Node struct {
+			Address    string `json:"Address"`
+			Node       string `json:"Node"`
+			Datacenter string `json:"Datacenter"`
+		} `json:"Node"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		upstreamErrors.WithLabelValues("parse").Inc()
+		return addressFamilySet{}, 0, err
+	}
+
+	var fresh addressFamilySet
+	for _, entry := range result {
+		// Only include services with passing health
+		healthy := true
+		for _, check := range entry.Checks {
+			if check.Status != "passing" {
+				healthy = false
+				break
+			}
+		}
+		if !healthy {
+			continue
+		}
+		ip := net.ParseIP(entry.Service.Address)
+		if ip == nil {
+			ip = net.ParseIP(entry.Node.Address)
+		}
+		if ip == nil {
+			continue
+		}
+		inst := serviceInstance{
+			IP:         ip,
+			Port:       entry.Service.Port,
+			Node:       entry.Node.Node,
+			Tags:       entry.Service.Tags,
+			Datacenter: entry.Node.Datacenter,
+		}
+		if ip.To4() != nil {
+			fresh.V4 = append(fresh.V4, inst)
+		} else {
+			fresh.V6 = append(fresh.V6, inst)
+		}
+	}
+
+	newIndex, _ := strconv.ParseUint(resp.Header.Get("X-Nomad-Index"), 10, 64)
+	return fresh, newIndex, nil
+}
+
+func (n *Nomad) Name() string { return "nomad" }
@@ -0,0 +1,121 @@
+package nomad
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want query
+	}{
+		{"bare service", "web", query{service: "web"}},
+		{"tag filter", "canary.web", query{tag: "canary", service: "web"}},
+		{"service proto filter", "_web._udp", query{service: "web", proto: "udp"}},
+		{"service proto tcp filter", "_web._tcp", query{service: "web", proto: "tcp"}},
+		{"multi-label service falls through", "a.b.web", query{service: "a.b.web"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseQuery(tt.in); got != tt.want {
+				t.Errorf("parseQuery(%q) = %+v, want %+v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryMatches(t *testing.T) {
+	inst := serviceInstance{Tags: []string{"canary", "udp"}}
+
+	tests := []struct {
+		name string
+		q    query
+		inst serviceInstance
+		want bool
+	}{
+		{"no filters matches anything", query{service: "web"}, inst, true},
+		{"matching tag", query{tag: "canary"}, inst, true},
+		{"non-matching tag", query{tag: "stable"}, inst, false},
+		{"default tcp proto matches untagged", query{proto: "tcp"}, serviceInstance{}, true},
+		{"tcp proto excludes instance tagged udp", query{proto: "tcp"}, inst, false},
+		{"udp proto requires udp tag", query{proto: "udp"}, inst, true},
+		{"udp proto rejects instance without tag", query{proto: "udp"}, serviceInstance{}, false},
+		{"tag and proto both required", query{tag: "canary", proto: "udp"}, inst, true},
+		{"tag and proto, proto missing", query{tag: "canary", proto: "udp"}, serviceInstance{Tags: []string{"canary"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.q.matches(tt.inst); got != tt.want {
+				t.Errorf("query%+v.matches(%+v) = %v, want %v", tt.q, tt.inst, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddressFamilySetFilter(t *testing.T) {
+	set := addressFamilySet{
+		V4: []serviceInstance{
+			{IP: net.ParseIP("10.0.0.1"), Tags: []string{"canary"}},
+			{IP: net.ParseIP("10.0.0.2"), Tags: []string{"stable"}},
+		},
+		V6: []serviceInstance{
+			{IP: net.ParseIP("::1"), Tags: []string{"canary"}},
+		},
+	}
+
+	got := set.filter(query{tag: "canary"})
+	if len(got.V4) != 1 || !got.V4[0].IP.Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("filter: unexpected V4 result %+v", got.V4)
+	}
+	if len(got.V6) != 1 || !got.V6[0].IP.Equal(net.ParseIP("::1")) {
+		t.Errorf("filter: unexpected V6 result %+v", got.V6)
+	}
+}
+
+func TestAddressFamilySetOrdered(t *testing.T) {
+	v4 := serviceInstance{IP: net.ParseIP("10.0.0.1")}
+	v6 := serviceInstance{IP: net.ParseIP("::1")}
+	set := addressFamilySet{V4: []serviceInstance{v4}, V6: []serviceInstance{v6}}
+
+	tests := []struct {
+		name   string
+		prefer string
+		want   []serviceInstance
+	}{
+		{"prefer v4", "v4", []serviceInstance{v4, v6}},
+		{"prefer v6", "v6", []serviceInstance{v6, v4}},
+		{"prefer dual falls back to v4 first", "dual", []serviceInstance{v4, v6}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := set.ordered(tt.prefer); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ordered(%q) = %+v, want %+v", tt.prefer, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeLabel(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"web-01", "web-01"},
+		{"node.us-east-1", "node-us-east-1"},
+		{"node_1", "node-1"},
+		{"Node:1", "Node-1"},
+	}
+	for _, tt := range tests {
+		if got := sanitizeLabel(tt.in); got != tt.want {
+			t.Errorf("sanitizeLabel(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestNodeTarget(t *testing.T) {
+	got := nodeTarget("node.us-east-1", "example.org.")
+	want := "node-us-east-1.node.example.org."
+	if got != want {
+		t.Errorf("nodeTarget() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,99 @@
+package nomad
+
+import (
+	"net"
+	"net/http"
+)
+
+// backend bundles everything needed to query one Nomad cluster: its address
+// and credentials, plus the locality hints used to steer EDNS0
+// client-subnet aware routing across regions.
+type backend struct {
+	Name       string
+	NomadAddr  string
+	Token      string
+	Datacenter string
+	CIDRs      []*net.IPNet
+	HTTPClient *http.Client
+
+	// BlockingHTTPClient is used instead of HTTPClient for watchers' blocking
+	// queries; see nomadBlockingWait in client.go for why it needs its own,
+	// longer Timeout.
+	BlockingHTTPClient *http.Client
+}
+
+// defaultBackend returns the single-region backend derived from the
+// plugin's own top-level configuration, used whenever no "region" blocks
+// are configured.
+func (n *Nomad) defaultBackend() *backend {
+	return &backend{
+		NomadAddr:          n.NomadAddr,
+		Token:              n.Token,
+		HTTPClient:         n.HTTPClient,
+		BlockingHTTPClient: n.BlockingHTTPClient,
+	}
+}
+
+// orderBackends returns the configured regions to try, in the order they
+// should be queried: any region whose CIDRs contain clientIP first (in
+// Corefile declaration order), then the rest as fallback. The second
+// return value is the matched CIDR's prefix length (0 if clientIP is nil
+// or matched nothing), used to scope the echoed EDNS0 Client Subnet option
+// and the response TTL.
+func (n *Nomad) orderBackends(clientIP net.IP) ([]*backend, int) {
+	if len(n.Regions) == 0 {
+		return []*backend{n.defaultBackend()}, 0
+	}
+	if clientIP == nil {
+		return append([]*backend{}, n.Regions...), 0
+	}
+
+	var matched, rest []*backend
+	scope := 0
+	for _, b := range n.Regions {
+		if ones := matchScope(b, clientIP); ones > 0 {
+			matched = append(matched, b)
+			if ones > scope {
+				scope = ones
+			}
+		} else {
+			rest = append(rest, b)
+		}
+	}
+	return append(matched, rest...), scope
+}
+
+// matchScope returns the prefix length of the most specific CIDR in b that
+// contains ip, or 0 if none match.
+func matchScope(b *backend, ip net.IP) int {
+	best := 0
+	for _, cidr := range b.CIDRs {
+		if !cidr.Contains(ip) {
+			continue
+		}
+		ones, _ := cidr.Mask.Size()
+		if ones > best {
+			best = ones
+		}
+	}
+	return best
+}
+
+// sortByDatacenter stable-partitions instances so the ones whose
+// Datacenter matches dc come first, for tie-breaking within a region once
+// its backend has been chosen.
+func sortByDatacenter(instances []serviceInstance, dc string) []serviceInstance {
+	if dc == "" || len(instances) == 0 {
+		return instances
+	}
+	out := make([]serviceInstance, 0, len(instances))
+	var rest []serviceInstance
+	for _, inst := range instances {
+		if inst.Datacenter == dc {
+			out = append(out, inst)
+		} else {
+			rest = append(rest, inst)
+		}
+	}
+	return append(out, rest...)
+}
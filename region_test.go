@@ -0,0 +1,99 @@
+package nomad
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestSortByDatacenter(t *testing.T) {
+	dc1 := serviceInstance{Node: "a", Datacenter: "dc1"}
+	dc2 := serviceInstance{Node: "b", Datacenter: "dc2"}
+	dc1b := serviceInstance{Node: "c", Datacenter: "dc1"}
+
+	tests := []struct {
+		name string
+		in   []serviceInstance
+		dc   string
+		want []serviceInstance
+	}{
+		{"empty dc is a no-op", []serviceInstance{dc2, dc1}, "", []serviceInstance{dc2, dc1}},
+		{"matching dc first, order preserved within groups", []serviceInstance{dc2, dc1, dc1b}, "dc1", []serviceInstance{dc1, dc1b, dc2}},
+		{"no matches leaves order untouched", []serviceInstance{dc2, dc1}, "dc3", []serviceInstance{dc2, dc1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sortByDatacenter(tt.in, tt.dc); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("sortByDatacenter() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func mustCIDR(t *testing.T, s string) *net.IPNet {
+	t.Helper()
+	_, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatalf("ParseCIDR(%q): %v", s, err)
+	}
+	return ipnet
+}
+
+func TestOrderBackends(t *testing.T) {
+	east := &backend{Name: "east", CIDRs: []*net.IPNet{mustCIDR(t, "10.0.0.0/24")}}
+	west := &backend{Name: "west", CIDRs: []*net.IPNet{mustCIDR(t, "10.1.0.0/16")}}
+	n := &Nomad{Regions: []*backend{east, west}}
+
+	t.Run("no client IP preserves declaration order", func(t *testing.T) {
+		got, scope := n.orderBackends(nil)
+		if !reflect.DeepEqual(got, []*backend{east, west}) || scope != 0 {
+			t.Errorf("orderBackends(nil) = %+v, scope %d", got, scope)
+		}
+	})
+
+	t.Run("matching region is promoted first", func(t *testing.T) {
+		got, scope := n.orderBackends(net.ParseIP("10.1.2.3"))
+		if len(got) != 2 || got[0] != west || got[1] != east {
+			t.Errorf("orderBackends() = %+v, want [west east]", got)
+		}
+		if scope != 16 {
+			t.Errorf("orderBackends() scope = %d, want 16", scope)
+		}
+	})
+
+	t.Run("unmatched IP falls back to declaration order", func(t *testing.T) {
+		got, scope := n.orderBackends(net.ParseIP("192.168.1.1"))
+		if !reflect.DeepEqual(got, []*backend{east, west}) || scope != 0 {
+			t.Errorf("orderBackends() = %+v, scope %d", got, scope)
+		}
+	})
+
+	t.Run("no regions configured uses defaultBackend", func(t *testing.T) {
+		n := &Nomad{NomadAddr: "http://nomad.example:4646"}
+		got, scope := n.orderBackends(net.ParseIP("10.1.2.3"))
+		if len(got) != 1 || got[0].NomadAddr != n.NomadAddr || scope != 0 {
+			t.Errorf("orderBackends() = %+v, scope %d", got, scope)
+		}
+	})
+}
+
+func TestMatchScope(t *testing.T) {
+	b := &backend{CIDRs: []*net.IPNet{mustCIDR(t, "10.0.0.0/16"), mustCIDR(t, "10.0.1.0/24")}}
+
+	tests := []struct {
+		name string
+		ip   net.IP
+		want int
+	}{
+		{"matches most specific CIDR", net.ParseIP("10.0.1.5"), 24},
+		{"matches broader CIDR only", net.ParseIP("10.0.2.5"), 16},
+		{"matches nothing", net.ParseIP("192.168.0.1"), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchScope(b, tt.ip); got != tt.want {
+				t.Errorf("matchScope() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,256 @@
+package nomad
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/coredns/coredns/plugin"
+	"github.com/miekg/dns"
+)
+
+func init() { plugin.Register("nomad", setup) }
+
+func setup(c *caddy.Controller) error {
+	n, err := parseNomad(c)
+	if err != nil {
+		return plugin.Error("nomad", err)
+	}
+
+	c.OnShutdown(func() error {
+		return n.Shutdown()
+	})
+
+	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
+		n.Next = next
+		return n
+	})
+
+	return nil
+}
+
+// parseNomad reads the "nomad" Corefile stanza into a Nomad plugin instance.
+//
+//	nomad [DOMAIN] {
+//	    address NOMAD_ADDR
+//	    ttl DURATION
+//	    watch
+//	    max_watchers N
+//	    token TOKEN
+//	    token_file PATH
+//	    ca_file PATH
+//	    cert_file PATH
+//	    key_file PATH
+//	    tls_server_name NAME
+//	    insecure_skip_verify
+//	    allow_insecure_token
+//	    timeout DURATION
+//	    prefer v4|v6|dual
+//	    ipv4_only
+//	    ipv6_only
+//	    region REGION_NAME {
+//	        address NOMAD_ADDR
+//	        token TOKEN
+//	        datacenter DC
+//	        cidr CIDR [CIDR...]
+//	    }
+//	}
+func parseNomad(c *caddy.Controller) (*Nomad, error) {
+	n := New()
+	cfg := &clientConfig{}
+
+	for c.Next() {
+		args := c.RemainingArgs()
+		if len(args) > 0 {
+			n.Domain = dns.Fqdn(args[0])
+		}
+
+		for c.NextBlock() {
+			switch c.Val() {
+			case "address":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				n.NomadAddr = c.Val()
+			case "ttl":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				ttl, err := time.ParseDuration(c.Val())
+				if err != nil {
+					return nil, err
+				}
+				n.CacheTTL = ttl
+			case "watch":
+				n.Watch = true
+			case "max_watchers":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				max, err := strconv.Atoi(c.Val())
+				if err != nil {
+					return nil, err
+				}
+				n.MaxWatchers = max
+			case "token":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				cfg.Token = c.Val()
+			case "token_file":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				cfg.TokenFile = c.Val()
+			case "ca_file":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				cfg.CAFile = c.Val()
+			case "cert_file":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				cfg.CertFile = c.Val()
+			case "key_file":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				cfg.KeyFile = c.Val()
+			case "tls_server_name":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				cfg.TLSServerName = c.Val()
+			case "insecure_skip_verify":
+				cfg.InsecureSkipVerify = true
+			case "allow_insecure_token":
+				cfg.AllowInsecureToken = true
+			case "timeout":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				timeout, err := time.ParseDuration(c.Val())
+				if err != nil {
+					return nil, err
+				}
+				cfg.Timeout = timeout
+			case "prefer":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				switch c.Val() {
+				case "v4", "v6", "dual":
+					n.Prefer = c.Val()
+				default:
+					return nil, c.Errf("prefer must be v4, v6, or dual, got %q", c.Val())
+				}
+			case "ipv4_only":
+				n.IPv4Only = true
+			case "ipv6_only":
+				n.IPv6Only = true
+			case "region":
+				rb, err := parseRegion(c)
+				if err != nil {
+					return nil, err
+				}
+				n.Regions = append(n.Regions, rb)
+			default:
+				return nil, c.ArgErr()
+			}
+		}
+	}
+
+	if n.IPv4Only && n.IPv6Only {
+		return nil, c.Errf("ipv4_only and ipv6_only are mutually exclusive")
+	}
+	if n.Domain == "" {
+		return nil, c.ArgErr()
+	}
+	if n.NomadAddr == "" {
+		return nil, c.ArgErr()
+	}
+	if !strings.HasPrefix(n.NomadAddr, "http://") && !strings.HasPrefix(n.NomadAddr, "https://") {
+		return nil, c.Errf("address must be an http:// or https:// URL, got %q", n.NomadAddr)
+	}
+
+	token, err := cfg.resolveToken(n.NomadAddr)
+	if err != nil {
+		return nil, err
+	}
+	n.Token = token
+
+	client, blockingClient, err := buildHTTPClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	n.HTTPClient = client
+	n.BlockingHTTPClient = blockingClient
+
+	for _, rb := range n.Regions {
+		if rb.NomadAddr == "" {
+			rb.NomadAddr = n.NomadAddr
+		}
+		if !strings.HasPrefix(rb.NomadAddr, "http://") && !strings.HasPrefix(rb.NomadAddr, "https://") {
+			return nil, c.Errf("region %q: address must be an http:// or https:// URL, got %q", rb.Name, rb.NomadAddr)
+		}
+		if rb.Token == "" {
+			rb.Token = n.Token
+		}
+		if err := checkPlaintextToken(rb.Token, rb.NomadAddr, cfg.AllowInsecureToken); err != nil {
+			return nil, c.Errf("region %q: %v", rb.Name, err)
+		}
+		rb.HTTPClient = client
+		rb.BlockingHTTPClient = blockingClient
+	}
+
+	return n, nil
+}
+
+// parseRegion reads one "region NAME { ... }" block into a backend.
+func parseRegion(c *caddy.Controller) (*backend, error) {
+	args := c.RemainingArgs()
+	if len(args) != 1 {
+		return nil, c.ArgErr()
+	}
+	rb := &backend{Name: args[0]}
+
+	for c.NextBlock() {
+		switch c.Val() {
+		case "address":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			rb.NomadAddr = c.Val()
+		case "token":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			rb.Token = c.Val()
+		case "datacenter":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			rb.Datacenter = c.Val()
+		case "cidr":
+			cidrs := c.RemainingArgs()
+			if len(cidrs) == 0 {
+				return nil, c.ArgErr()
+			}
+			for _, s := range cidrs {
+				_, ipnet, err := net.ParseCIDR(s)
+				if err != nil {
+					return nil, err
+				}
+				rb.CIDRs = append(rb.CIDRs, ipnet)
+			}
+		default:
+			return nil, c.ArgErr()
+		}
+	}
+
+	return rb, nil
+}
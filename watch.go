@@ -0,0 +1,151 @@
+package nomad
+
+import (
+	"time"
+)
+
+// watcher tracks a single long-polling goroutine keeping one
+// backend+service cache entry fresh via Nomad blocking queries.
+type watcher struct {
+	backend  *backend
+	service  string
+	key      string
+	index    uint64
+	lastUsed time.Time
+	stop     chan struct{}
+}
+
+// touchWatcher records recent use of a cache key's watcher so it isn't
+// picked by the idle-LRU eviction in startWatcher.
+func (n *Nomad) touchWatcher(key string) {
+	n.watchersMu.Lock()
+	if w, ok := n.watchers[key]; ok {
+		w.lastUsed = time.Now()
+	}
+	n.watchersMu.Unlock()
+}
+
+// startWatcher spawns a watcher goroutine for b/service seeded at index,
+// evicting the least recently used watcher first if MaxWatchers is
+// already reached. A no-op if a watcher for this backend/service is
+// already running.
+func (n *Nomad) startWatcher(b *backend, service string, index uint64) {
+	key := cacheKey(b, service)
+
+	n.watchersMu.Lock()
+	defer n.watchersMu.Unlock()
+
+	if w, ok := n.watchers[key]; ok {
+		w.lastUsed = time.Now()
+		return
+	}
+
+	if n.MaxWatchers > 0 && len(n.watchers) >= n.MaxWatchers {
+		n.evictIdlestLocked()
+	}
+
+	w := &watcher{
+		backend:  b,
+		service:  service,
+		key:      key,
+		index:    index,
+		lastUsed: time.Now(),
+		stop:     make(chan struct{}),
+	}
+	n.watchers[key] = w
+
+	n.wg.Add(1)
+	go n.runWatcher(w)
+}
+
+// evictIdlestLocked stops and removes the least recently touched watcher,
+// along with its cache entry. Callers must hold watchersMu.
+//
+// The cache entry has to go too: lookupServiceWatched only starts a new
+// watcher on a cache miss, so leaving the stale entry behind would freeze
+// that service at its last-seen value forever, with no watcher left to
+// refresh it and no miss to trigger a replacement.
+func (n *Nomad) evictIdlestLocked() {
+	var idlestKey string
+	var idlestAt time.Time
+	for key, w := range n.watchers {
+		if idlestKey == "" || w.lastUsed.Before(idlestAt) {
+			idlestKey = key
+			idlestAt = w.lastUsed
+		}
+	}
+	if idlestKey == "" {
+		return
+	}
+	close(n.watchers[idlestKey].stop)
+	delete(n.watchers, idlestKey)
+
+	n.CacheMutex.Lock()
+	delete(n.Cache, idlestKey)
+	delete(n.CacheTime, idlestKey)
+	n.setCacheEntries()
+	n.CacheMutex.Unlock()
+}
+
+// runWatcher is the watcher goroutine body: it repeatedly issues blocking
+// queries seeded with the last seen Nomad index and replaces the cached
+// entry for w.key the moment the index advances. It exits when w.stop or
+// n.shutdown is closed.
+func (n *Nomad) runWatcher(w *watcher) {
+	defer n.wg.Done()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-n.shutdown:
+			return
+		default:
+		}
+
+		instances, index, err := n.fetchHealth(w.backend, w.service, w.index, true)
+		if err != nil {
+			select {
+			case <-time.After(5 * time.Second):
+			case <-w.stop:
+				return
+			case <-n.shutdown:
+				return
+			}
+			continue
+		}
+
+		if index > w.index {
+			w.index = index
+			n.CacheMutex.Lock()
+			// evictIdlestLocked closes w.stop before it takes CacheMutex to
+			// drop the entry, so checking here under the lock keeps a query
+			// that returns after eviction from writing the entry back.
+			select {
+			case <-w.stop:
+				n.CacheMutex.Unlock()
+				return
+			default:
+			}
+			n.Cache[w.key] = instances
+			n.CacheTime[w.key] = time.Now()
+			n.CacheMutex.Unlock()
+		}
+	}
+}
+
+// Shutdown stops every running watcher and waits for their goroutines to
+// exit. It is wired to the CoreDNS plugin lifecycle via c.OnShutdown in
+// setup.go.
+func (n *Nomad) Shutdown() error {
+	close(n.shutdown)
+
+	n.watchersMu.Lock()
+	for _, w := range n.watchers {
+		close(w.stop)
+	}
+	n.watchersMu.Unlock()
+
+	n.wg.Wait()
+	return nil
+}
@@ -0,0 +1,77 @@
+package nomad
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestNomadForWatchers() *Nomad {
+	n := New()
+	return n
+}
+
+func TestEvictIdlestLocked(t *testing.T) {
+	n := newTestNomadForWatchers()
+
+	older := &watcher{key: "b1/old", lastUsed: time.Now().Add(-time.Minute), stop: make(chan struct{})}
+	newer := &watcher{key: "b1/new", lastUsed: time.Now(), stop: make(chan struct{})}
+	n.watchers[older.key] = older
+	n.watchers[newer.key] = newer
+
+	n.Cache[older.key] = addressFamilySet{V4: []serviceInstance{{Port: 1}}}
+	n.Cache[newer.key] = addressFamilySet{V4: []serviceInstance{{Port: 2}}}
+	n.CacheTime[older.key] = time.Now()
+	n.CacheTime[newer.key] = time.Now()
+
+	n.watchersMu.Lock()
+	n.evictIdlestLocked()
+	n.watchersMu.Unlock()
+
+	if _, ok := n.watchers[older.key]; ok {
+		t.Errorf("evictIdlestLocked() left the idlest watcher in place")
+	}
+	if _, ok := n.watchers[newer.key]; !ok {
+		t.Errorf("evictIdlestLocked() evicted the wrong watcher")
+	}
+
+	select {
+	case <-older.stop:
+	default:
+		t.Errorf("evictIdlestLocked() did not stop the evicted watcher")
+	}
+
+	// The cache entry must go with the watcher: lookupServiceWatched only
+	// starts a fresh watcher on a cache miss, so a stale entry left behind
+	// would freeze that service with no way to recover.
+	n.CacheMutex.RLock()
+	_, cacheOk := n.Cache[older.key]
+	_, timeOk := n.CacheTime[older.key]
+	n.CacheMutex.RUnlock()
+	if cacheOk || timeOk {
+		t.Errorf("evictIdlestLocked() left a stale cache entry for the evicted watcher")
+	}
+
+	n.CacheMutex.RLock()
+	_, stillCached := n.Cache[newer.key]
+	n.CacheMutex.RUnlock()
+	if !stillCached {
+		t.Errorf("evictIdlestLocked() removed the surviving watcher's cache entry")
+	}
+}
+
+func TestTouchWatcherUpdatesLastUsed(t *testing.T) {
+	n := newTestNomadForWatchers()
+	w := &watcher{key: "b1/web", lastUsed: time.Now().Add(-time.Hour), stop: make(chan struct{})}
+	n.watchers[w.key] = w
+
+	n.touchWatcher(w.key)
+
+	if time.Since(w.lastUsed) > time.Second {
+		t.Errorf("touchWatcher() did not refresh lastUsed")
+	}
+}
+
+func TestTouchWatcherUnknownKeyIsNoop(t *testing.T) {
+	n := newTestNomadForWatchers()
+	n.touchWatcher("does-not-exist") // must not panic
+}